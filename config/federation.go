@@ -0,0 +1,54 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// federationConfigName is the file under GDDirSuffix that lists the
+// additional Drive accounts a Push can mirror to.
+const federationConfigName = "federation.json"
+
+// FederationTarget is one additional Drive account configured in
+// .gd/federation.json for `drive push --federate`.
+type FederationTarget struct {
+	Name            string `json:"name"`
+	CredentialsPath string `json:"credentials_path"`
+	RootFolderId    string `json:"root_folder_id"`
+}
+
+// LoadFederationTargets reads root/.gd/federation.json. A missing file is
+// not an error: it simply means no federation targets are configured, so
+// `--federate` has nothing to mirror to.
+func LoadFederationTargets(root string) ([]FederationTarget, error) {
+	fpath := path.Join(root, GDDirSuffix, federationConfigName)
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var targets []FederationTarget
+	if uErr := json.Unmarshal(data, &targets); uErr != nil {
+		return nil, uErr
+	}
+	return targets, nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "strings"
+
+// IsHidden reports whether name should be skipped from a directory listing
+// because it's a dotfile and hidden is false. It's the single predicate
+// both Push's own directory walk and the contenthash cache apply, so the
+// cache never disagrees with what Push would actually enumerate.
+func IsHidden(name string, hidden bool) bool {
+	return !hidden && strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,42 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io"
+	"os"
+)
+
+// LocalFS abstracts the local filesystem operations Push and Pull need, so
+// a Context can be pointed at something other than the real disk: an
+// in-memory staging area in tests, or a tarball presented as though it were
+// the current directory.
+type LocalFS interface {
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Remove(path string) error
+	Readlink(path string) (string, error)
+}
+
+// FS returns the Context's filesystem abstraction, defaulting to the real
+// disk via OsFS when none has been set.
+func (c *Context) FS() LocalFS {
+	if c.Fs == nil {
+		return OsFS{}
+	}
+	return c.Fs
+}
@@ -0,0 +1,151 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// memFile is one entry of a MemFS: either a regular file's bytes or a
+// directory's set of child names.
+type memFile struct {
+	content  []byte
+	mode     os.FileMode
+	modTime  time.Time
+	isDir    bool
+	children map[string]bool
+}
+
+// memFileInfo adapts a memFile to os.FileInfo.
+type memFileInfo struct {
+	name string
+	f    *memFile
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.f.content)) }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.f.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.f.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.f.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// MemFS is an in-memory LocalFS, useful for exercising Push's resolver and
+// change-list logic in tests without touching disk.
+type MemFS struct {
+	files map[string]*memFile
+}
+
+// NewMemFS returns an empty in-memory filesystem rooted at "/".
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memFile{
+		"/": {isDir: true, mode: os.ModeDir | 0755, modTime: time.Time{}, children: map[string]bool{}},
+	}}
+}
+
+func (m *MemFS) ensureDir(p string) *memFile {
+	p = path.Clean(p)
+	if f, ok := m.files[p]; ok {
+		return f
+	}
+	f := &memFile{isDir: true, mode: os.ModeDir | 0755, children: map[string]bool{}}
+	m.files[p] = f
+	if p != "/" {
+		parent := m.ensureDir(path.Dir(p))
+		parent.children[path.Base(p)] = true
+	}
+	return f
+}
+
+// AddFile registers a regular file at p with the given content, mode and
+// modification time, creating any missing parent directories.
+func (m *MemFS) AddFile(p string, content []byte, mode os.FileMode, modTime time.Time) {
+	p = path.Clean(p)
+	parent := m.ensureDir(path.Dir(p))
+	parent.children[path.Base(p)] = true
+	m.files[p] = &memFile{content: content, mode: mode, modTime: modTime}
+}
+
+// AddDir registers an empty directory at p, creating any missing parents.
+func (m *MemFS) AddDir(p string) {
+	m.ensureDir(p)
+}
+
+func (m *MemFS) Stat(p string) (os.FileInfo, error) {
+	p = path.Clean(p)
+	f, ok := m.files[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: path.Base(p), f: f}, nil
+}
+
+func (m *MemFS) Lstat(p string) (os.FileInfo, error) { return m.Stat(p) }
+
+func (m *MemFS) Open(p string) (io.ReadCloser, error) {
+	p = path.Clean(p)
+	f, ok := m.files[p]
+	if !ok || f.isDir {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+func (m *MemFS) ReadDir(p string) ([]os.FileInfo, error) {
+	p = path.Clean(p)
+	dir, ok := m.files[p]
+	if !ok || !dir.isDir {
+		return nil, os.ErrNotExist
+	}
+
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		childPath := path.Join(p, name)
+		child := m.files[childPath]
+		if child == nil {
+			continue
+		}
+		infos = append(infos, memFileInfo{name: name, f: child})
+	}
+	return infos, nil
+}
+
+func (m *MemFS) Remove(p string) error {
+	p = path.Clean(p)
+	if _, ok := m.files[p]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.files, p)
+	if parent, ok := m.files[path.Dir(p)]; ok {
+		delete(parent.children, path.Base(p))
+	}
+	return nil
+}
+
+// Readlink always fails: MemFS has no notion of symlinks.
+func (m *MemFS) Readlink(p string) (string, error) {
+	return "", os.ErrInvalid
+}
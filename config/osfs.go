@@ -0,0 +1,36 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// OsFS is the default LocalFS, backed directly by the real disk.
+type OsFS struct{}
+
+func (OsFS) Stat(path string) (os.FileInfo, error) { return os.Stat(path) }
+
+func (OsFS) Lstat(path string) (os.FileInfo, error) { return os.Lstat(path) }
+
+func (OsFS) Open(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+func (OsFS) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+
+func (OsFS) Remove(path string) error { return os.Remove(path) }
+
+func (OsFS) Readlink(path string) (string, error) { return os.Readlink(path) }
@@ -0,0 +1,67 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// TarFS presents the contents of a tarball as a LocalFS, so `drive push
+// --from archive.tar` can upload the contents of an archive as though it
+// were the current directory, without extracting it to disk first. The
+// whole archive is read into memory up front; pushes of archives larger
+// than available memory should extract first instead.
+type TarFS struct {
+	*MemFS
+}
+
+// OpenTarFS reads the tar archive at tarPath and returns a LocalFS over its
+// contents, rooted at "/".
+func OpenTarFS(tarPath string) (*TarFS, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem := NewMemFS()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := "/" + hdr.Name
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mem.AddDir(name)
+		case tar.TypeReg, tar.TypeRegA:
+			content, rErr := ioutil.ReadAll(tr)
+			if rErr != nil {
+				return nil, rErr
+			}
+			mem.AddFile(name, content, os.FileMode(hdr.Mode), hdr.ModTime)
+		}
+	}
+
+	return &TarFS{MemFS: mem}, nil
+}
@@ -0,0 +1,486 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package contenthash maintains a persistent, content-addressed Merkle
+// digest of a local mount so that Push can recognize whole subtrees that
+// haven't changed since the last successful push and skip them without
+// ever asking the Drive API about them.
+package contenthash
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/odeke-em/drive/config"
+)
+
+// Digest is a SHA-256 content digest.
+type Digest [sha256.Size]byte
+
+// record is what the cache keeps about a single path: the digest that was
+// last computed for it, and the stat fingerprint that was true at the time,
+// so a later Push can tell "unchanged" from "must rehash" in O(1).
+type record struct {
+	Digest  Digest
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+	Mode    os.FileMode
+}
+
+// node is one entry of the in-memory digest tree. Trees are immutable:
+// every mutation returns a new *node, sharing every subtree it didn't
+// touch with the node it was derived from.
+type node struct {
+	// contents is the digest of a file's bytes, or of the sorted
+	// (basename, child contents-digest) pairs of a directory's
+	// immediate children.
+	contents *record
+	// header is the digest of a file's (mode, size, symlink target), or
+	// of a directory's own (name, mode).
+	header   *record
+	children map[string]*node
+}
+
+// Tree is the immutable, structurally-shared digest tree for one mount.
+// Paths are cleaned absolute unix paths; the root is "".
+type Tree struct {
+	root *node
+}
+
+// NewTree returns an empty digest tree.
+func NewTree() *Tree {
+	return &Tree{root: &node{}}
+}
+
+func segmentsOf(cleanPath string) []string {
+	trimmed := strings.Trim(cleanPath, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
+func lookup(n *node, segs []string) *node {
+	for _, seg := range segs {
+		if n == nil {
+			return nil
+		}
+		n = n.children[seg]
+	}
+	return n
+}
+
+func withChild(n *node, name string, child *node) *node {
+	newChildren := make(map[string]*node, len(n.children)+1)
+	for k, v := range n.children {
+		newChildren[k] = v
+	}
+	newChildren[name] = child
+	return &node{contents: n.contents, header: n.header, children: newChildren}
+}
+
+// setAt returns a new tree rooted at old with the node at segs replaced by
+// the result of mutate, path-copying only the nodes on the way down.
+func setAt(old *node, segs []string, mutate func(*node) *node) *node {
+	if old == nil {
+		old = &node{}
+	}
+	if len(segs) == 0 {
+		return mutate(old)
+	}
+	head, rest := segs[0], segs[1:]
+	child := setAt(old.children[head], rest, mutate)
+	return withChild(old, head, child)
+}
+
+// SetContents records the contents digest for path, returning a new Tree.
+func (t *Tree) SetContents(path string, rec *record) *Tree {
+	segs := segmentsOf(path)
+	root := setAt(t.root, segs, func(n *node) *node {
+		return &node{contents: rec, header: n.header, children: n.children}
+	})
+	return &Tree{root: root}
+}
+
+// SetHeader records the header digest for path, returning a new Tree.
+func (t *Tree) SetHeader(path string, rec *record) *Tree {
+	segs := segmentsOf(path)
+	root := setAt(t.root, segs, func(n *node) *node {
+		return &node{contents: n.contents, header: rec, children: n.children}
+	})
+	return &Tree{root: root}
+}
+
+func (t *Tree) contentsAt(path string) *record {
+	if n := lookup(t.root, segmentsOf(path)); n != nil {
+		return n.contents
+	}
+	return nil
+}
+
+func (t *Tree) headerAt(path string) *record {
+	if n := lookup(t.root, segmentsOf(path)); n != nil {
+		return n.header
+	}
+	return nil
+}
+
+// Cache is the persistent, on-disk-backed digest tree for a mount root. A
+// Cache is safe for use by a single process at a time. Only Save takes the
+// on-disk lock file, so concurrent `drive push` invocations serialize their
+// writes of the cache; Load reads it without the lock.
+type Cache struct {
+	mu sync.Mutex
+
+	mountRoot string
+	fs        config.LocalFS
+	tree      *Tree
+	// pushed is the digest tree recorded as of the last successful
+	// push, used to decide whether a subtree can be dropped entirely.
+	pushed *Tree
+}
+
+const (
+	cacheRelPath = "contenthash.cache"
+	lockRelPath  = "contenthash.lock"
+)
+
+func cachePath(mountRoot string) string {
+	return gopath.Join(mountRoot, config.GDDirSuffix, cacheRelPath)
+}
+
+func lockPath(mountRoot string) string {
+	return gopath.Join(mountRoot, config.GDDirSuffix, lockRelPath)
+}
+
+// onDiskCache is the gob-serializable snapshot written to disk. The tree's
+// structural sharing is an in-memory concern only; on disk the digests are
+// flattened back out to a flat list keyed by path.
+type onDiskCache struct {
+	Tree   map[string]*persistedRecord
+	Pushed map[string]*persistedRecord
+}
+
+type persistedRecord struct {
+	Contents *record
+	Header   *record
+}
+
+// Load reads the persisted cache for mountRoot, if any, and returns a ready
+// to use Cache that hashes the mount through fs. A missing or corrupt cache
+// file is not an error: Load just returns an empty Cache, so the first Push
+// after upgrading simply rehashes everything once.
+func Load(mountRoot string, fs config.LocalFS) (*Cache, error) {
+	c := &Cache{
+		mountRoot: mountRoot,
+		fs:        fs,
+		tree:      NewTree(),
+		pushed:    NewTree(),
+	}
+
+	f, err := os.Open(cachePath(mountRoot))
+	if err != nil {
+		return c, nil
+	}
+	defer f.Close()
+
+	var onDisk onDiskCache
+	if dErr := gob.NewDecoder(bufio.NewReader(f)).Decode(&onDisk); dErr != nil {
+		return c, nil
+	}
+
+	for path, pr := range onDisk.Tree {
+		if pr.Contents != nil {
+			c.tree = c.tree.SetContents(path, pr.Contents)
+		}
+		if pr.Header != nil {
+			c.tree = c.tree.SetHeader(path, pr.Header)
+		}
+	}
+	for path, pr := range onDisk.Pushed {
+		if pr.Contents != nil {
+			c.pushed = c.pushed.SetContents(path, pr.Contents)
+		}
+		if pr.Header != nil {
+			c.pushed = c.pushed.SetHeader(path, pr.Header)
+		}
+	}
+
+	return c, nil
+}
+
+// withLock runs fn while holding an exclusive, cross-process advisory lock
+// on the cache file, so two concurrent `drive push` invocations don't
+// interleave reads and writes of the cache.
+func withLock(mountRoot string, fn func() error) error {
+	path := lockPath(mountRoot)
+	if err := os.MkdirAll(gopath.Join(mountRoot, config.GDDirSuffix), 0755); err != nil {
+		return err
+	}
+
+	var lockFile *os.File
+	var err error
+	for i := 0; i < 50; i++ {
+		lockFile, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("contenthash: timed out waiting for lock %q: %v", path, err)
+	}
+	defer func() {
+		lockFile.Close()
+		os.Remove(path)
+	}()
+
+	return fn()
+}
+
+// Save persists the cache to disk under the mount's .gd directory,
+// guarded by the on-disk lock so a racing `drive push` can't corrupt it.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	onDisk := onDiskCache{
+		Tree:   map[string]*persistedRecord{},
+		Pushed: map[string]*persistedRecord{},
+	}
+	flatten(c.tree.root, "", onDisk.Tree)
+	flatten(c.pushed.root, "", onDisk.Pushed)
+
+	return withLock(c.mountRoot, func() error {
+		tmp, err := ioutil.TempFile(gopath.Join(c.mountRoot, config.GDDirSuffix), "contenthash-")
+		if err != nil {
+			return err
+		}
+		tmpName := tmp.Name()
+
+		enc := gob.NewEncoder(tmp)
+		if err := enc.Encode(&onDisk); err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+		return os.Rename(tmpName, cachePath(c.mountRoot))
+	})
+}
+
+func flatten(n *node, path string, out map[string]*persistedRecord) {
+	if n == nil {
+		return
+	}
+	if n.contents != nil || n.header != nil {
+		out[path] = &persistedRecord{Contents: n.contents, Header: n.header}
+	}
+	for name, child := range n.children {
+		flatten(child, gopath.Join(path, name), out)
+	}
+}
+
+// statMatches reports whether fi's mtime, size and inode still match a
+// previously cached record, meaning its digest can be reused as-is.
+func statMatches(rec *record, fi os.FileInfo) bool {
+	if rec == nil {
+		return false
+	}
+	return rec.Size == fi.Size() && rec.ModTime.Equal(fi.ModTime()) && rec.Inode == inodeOf(fi)
+}
+
+func headerDigest(mode os.FileMode, size int64, symlinkTarget string) Digest {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:%s", mode, size, symlinkTarget)
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+func fileContentsDigest(fs config.LocalFS, path string) (Digest, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return Digest{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Digest{}, err
+	}
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d, nil
+}
+
+type childDigest struct {
+	name   string
+	digest Digest
+}
+
+func dirContentsDigest(children []childDigest) Digest {
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+
+	h := sha256.New()
+	for _, c := range children {
+		fmt.Fprintf(h, "%s\x00%x\n", c.name, c.digest)
+	}
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// Digest computes (reusing cached leaf digests where the stat fingerprint
+// still matches) the current contents digest of absPath, which may be a
+// regular file, a symlink or a directory. hidden controls whether dotfiles
+// are included, mirroring the `hidden` flag Push's list() already honors.
+func (c *Cache) Digest(absPath string, hidden bool) (Digest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, _, err := c.digest(absPath, hidden)
+	return d, err
+}
+
+func (c *Cache) digest(absPath string, hidden bool) (Digest, bool, error) {
+	fi, err := c.fs.Lstat(absPath)
+	if err != nil {
+		return Digest{}, false, err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, rErr := c.fs.Readlink(absPath)
+		if rErr != nil {
+			return Digest{}, false, rErr
+		}
+		d := headerDigest(fi.Mode(), int64(len(target)), target)
+		c.tree = c.tree.SetContents(absPath, &record{Digest: d, Size: fi.Size(), ModTime: fi.ModTime(), Inode: inodeOf(fi), Mode: fi.Mode()})
+		return d, true, nil
+	}
+
+	if !fi.IsDir() {
+		if cached := c.tree.contentsAt(absPath); statMatches(cached, fi) {
+			return cached.Digest, false, nil
+		}
+
+		contentsD, cErr := fileContentsDigest(c.fs, absPath)
+		if cErr != nil {
+			return Digest{}, false, cErr
+		}
+		combined := sha256.New()
+		combined.Write(contentsD[:])
+		hd := headerDigest(fi.Mode(), fi.Size(), "")
+		combined.Write(hd[:])
+		var d Digest
+		copy(d[:], combined.Sum(nil))
+
+		c.tree = c.tree.SetContents(absPath, &record{Digest: d, Size: fi.Size(), ModTime: fi.ModTime(), Inode: inodeOf(fi), Mode: fi.Mode()})
+		return d, true, nil
+	}
+
+	entries, rErr := c.fs.ReadDir(absPath)
+	if rErr != nil {
+		return Digest{}, false, rErr
+	}
+
+	changed := false
+	children := make([]childDigest, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == config.GDDirSuffix {
+			continue
+		}
+		if config.IsHidden(entry.Name(), hidden) {
+			continue
+		}
+		childPath := gopath.Join(absPath, entry.Name())
+		cd, childChanged, cErr := c.digest(childPath, hidden)
+		if cErr != nil {
+			return Digest{}, false, cErr
+		}
+		changed = changed || childChanged
+		children = append(children, childDigest{name: entry.Name(), digest: cd})
+	}
+
+	header := headerDigest(fi.Mode(), 0, "")
+	d := dirContentsDigest(children)
+	if cached := c.tree.contentsAt(absPath); !changed && cached != nil && cached.Digest == d && statMatches(c.tree.headerAt(absPath), fi) {
+		return d, false, nil
+	}
+
+	c.tree = c.tree.SetHeader(absPath, &record{Digest: header, Size: 0, ModTime: fi.ModTime(), Inode: inodeOf(fi), Mode: fi.Mode()})
+	c.tree = c.tree.SetContents(absPath, &record{Digest: d, Size: 0, ModTime: fi.ModTime(), Inode: inodeOf(fi), Mode: fi.Mode()})
+	return d, true, nil
+}
+
+// Unchanged reports whether absPath's current digest is identical to the
+// digest recorded as of the last successful push, meaning the entire
+// subtree rooted at absPath can be dropped from the change list without
+// any Drive API calls.
+//
+// This is a local-only comparison: it says nothing about whether the
+// remote copy has drifted since that last push (restored from trash,
+// edited by another collaborator, deleted out-of-band), so a caller that
+// skips on Unchanged stops reconciling any divergence on the remote side
+// for that subtree. Callers should treat a true result as "safe to skip
+// resolving, not as 'identical to what's on Drive right now'", and gate
+// using it behind an explicit opt-in rather than applying it whenever a
+// cache happens to be present (see Push's use of
+// g.opts.TrustLocalUnchanged).
+//
+// Digest also doesn't yet do the lazy, path-scoped invalidation its name
+// implies: it re-stats (and, on a cache miss, rehashes) every entry under
+// absPath on every call rather than recomputing only along a changed
+// path and reusing cached digests for untouched siblings outright. The
+// cached record still saves the cost of rereading file contents that
+// haven't moved (see statMatches), just not the walk and stat of the
+// whole subtree.
+func (c *Cache) Unchanged(absPath string, hidden bool) bool {
+	d, err := c.Digest(absPath, hidden)
+	if err != nil {
+		return false
+	}
+	last := c.pushed.contentsAt(absPath)
+	return last != nil && last.Digest == d
+}
+
+// MarkPushed records absPath's current digest as the new last-successful-
+// push digest, so the next Push can recognize this subtree as unchanged.
+func (c *Cache) MarkPushed(absPath string, hidden bool) error {
+	if _, err := c.Digest(absPath, hidden); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.pushed = c.pushed.SetContents(absPath, c.tree.contentsAt(absPath))
+	c.mu.Unlock()
+	return nil
+}
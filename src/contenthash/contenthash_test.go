@@ -0,0 +1,115 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contenthash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/odeke-em/drive/config"
+)
+
+func newMemCache(fs config.LocalFS) *Cache {
+	return &Cache{mountRoot: "/mnt", fs: fs, tree: NewTree(), pushed: NewTree()}
+}
+
+func TestDigestReusesCachedRecordWhenStatUnchanged(t *testing.T) {
+	fs := config.NewMemFS()
+	mt := time.Unix(1000, 0)
+	fs.AddFile("/a.txt", []byte("hello"), 0644, mt)
+
+	c := newMemCache(fs)
+	d1, err := c.Digest("/a.txt", false)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+
+	// Same size, same mtime: Digest should trust the cached record rather
+	// than reread content it has no stat-level reason to believe changed.
+	fs.AddFile("/a.txt", []byte("HELLO"), 0644, mt)
+
+	d2, err := c.Digest("/a.txt", false)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if d1 != d2 {
+		t.Errorf("Digest changed despite a matching stat fingerprint: %x != %x", d1, d2)
+	}
+}
+
+func TestDigestRecomputesWhenStatChanges(t *testing.T) {
+	fs := config.NewMemFS()
+	fs.AddFile("/a.txt", []byte("hello"), 0644, time.Unix(1000, 0))
+
+	c := newMemCache(fs)
+	d1, err := c.Digest("/a.txt", false)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+
+	fs.AddFile("/a.txt", []byte("world!"), 0644, time.Unix(2000, 0))
+
+	d2, err := c.Digest("/a.txt", false)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if d1 == d2 {
+		t.Errorf("Digest did not change after a file's content and stat both changed")
+	}
+}
+
+func TestUnchangedAfterMarkPushed(t *testing.T) {
+	fs := config.NewMemFS()
+	fs.AddFile("/dir/a.txt", []byte("hello"), 0644, time.Unix(1000, 0))
+	fs.AddFile("/dir/b.txt", []byte("world"), 0644, time.Unix(1000, 0))
+
+	c := newMemCache(fs)
+
+	if c.Unchanged("/dir", false) {
+		t.Fatalf("a subtree that's never been pushed should not read as unchanged")
+	}
+
+	if err := c.MarkPushed("/dir", false); err != nil {
+		t.Fatalf("MarkPushed: %v", err)
+	}
+	if !c.Unchanged("/dir", false) {
+		t.Errorf("subtree should read as unchanged immediately after MarkPushed")
+	}
+
+	fs.AddFile("/dir/a.txt", []byte("changed"), 0644, time.Unix(2000, 0))
+	if c.Unchanged("/dir", false) {
+		t.Errorf("subtree should no longer read as unchanged after a child file changed")
+	}
+}
+
+func TestUnchangedIgnoresHiddenFilesWhenHiddenIsFalse(t *testing.T) {
+	fs := config.NewMemFS()
+	fs.AddFile("/dir/a.txt", []byte("hello"), 0644, time.Unix(1000, 0))
+
+	c := newMemCache(fs)
+	if err := c.MarkPushed("/dir", false); err != nil {
+		t.Fatalf("MarkPushed: %v", err)
+	}
+
+	// Adding a dotfile shouldn't disturb a digest computed with hidden
+	// files excluded.
+	fs.AddFile("/dir/.hidden", []byte("secret"), 0644, time.Unix(1000, 0))
+	if !c.Unchanged("/dir", false) {
+		t.Errorf("subtree should still read as unchanged: a new dotfile isn't visible with hidden=false")
+	}
+	if c.Unchanged("/dir", true) {
+		t.Errorf("subtree should read as changed once the new dotfile is visible with hidden=true")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package drive
+
+import "os"
+
+// devIno has no portable equivalent on platforms without a Unix stat_t, so
+// symlink-cycle detection is simply unavailable there; callers treat a
+// false ok as "can't tell, assume no cycle".
+func devIno(fi os.FileInfo) (dev uint64, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,220 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drive
+
+import (
+	"errors"
+	"fmt"
+	gopath "path"
+	"sync"
+
+	"github.com/odeke-em/drive/config"
+)
+
+// ErrFederationRemoteUnconfigured is returned by the default
+// RemoteForAccount when nothing has wired up a way to mint a *Remote for a
+// federation target's credentials. The OAuth bootstrap that does this for
+// the primary account lives in the command-line entry point, not here;
+// that entry point is expected to set RemoteForAccount at startup the same
+// way it constructs g.rem for the primary account.
+//
+// That entry point isn't part of this package, so --federate ships inert
+// until it sets RemoteForAccount: pushFederated surfaces that loudly (see
+// its "none of N target(s) could be reached" error) rather than letting it
+// pass as a quiet no-op.
+var ErrFederationRemoteUnconfigured = errors.New("federate: no RemoteForAccount constructor configured")
+
+// RemoteForAccount mints a *Remote scoped to a federation target's
+// credentials and root folder (target.CredentialsPath, target.RootFolderId).
+// It's a package-level hook rather than a constructor call here because
+// building a Remote means running the same OAuth bootstrap the primary
+// account goes through, which this package doesn't own. Wiring it up is the
+// command-line entry point's responsibility, the same way it already
+// constructs the primary account's *Remote before calling Push.
+var RemoteForAccount = func(target config.FederationTarget) (*Remote, error) {
+	return nil, ErrFederationRemoteUnconfigured
+}
+
+// federationTargets resolves which additional Drive accounts this Push
+// should mirror to: everything in .gd/federation.json when g.opts.Federate
+// is set, narrowed to the accounts named by --to when g.opts.FederateTo is
+// non-empty.
+func (g *Commands) federationTargets() ([]config.FederationTarget, error) {
+	if !g.opts.Federate && len(g.opts.FederateTo) == 0 {
+		return nil, nil
+	}
+
+	all, err := config.LoadFederationTargets(g.context.AbsPathOf(""))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.opts.FederateTo) == 0 {
+		return all, nil
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range g.opts.FederateTo {
+		wanted[name] = true
+	}
+
+	var picked []config.FederationTarget
+	for _, t := range all {
+		if wanted[t.Name] {
+			picked = append(picked, t)
+		}
+	}
+	return picked, nil
+}
+
+// fedIndexRoots maps a federated Commands clone to the index root its
+// remoteMod/remoteAdd/mkdirOne calls should serialize into, keyed by the
+// *Commands pointer itself since federatedCommands allocates a fresh one
+// per target. A federated clone shares g's Context (see federatedCommands)
+// so that g.context.AbsPathOf("") - the root SerializeIndex/DeserializeIndex
+// would otherwise use - resolves to the same path for every target.
+// Without this, every account's remote file IDs (which only make sense
+// within that account) would be serialized into the same
+// .gd/indices/<fileId> entry, so the last account pushed to clobbers the
+// index every other account, including the primary, relies on.
+var fedIndexRoots = struct {
+	mu    sync.Mutex
+	byCmd map[*Commands]string
+}{byCmd: map[*Commands]string{}}
+
+// indexRoot is the root remoteMod, remoteDelete and mkdirOne pass to
+// SerializeIndex/DeserializeIndex/IndicesAbsPath: the mount root for the
+// primary account, or a federated clone's own .gd/indices/<account>
+// namespace as installed by federatedCommands.
+func (g *Commands) indexRoot() string {
+	fedIndexRoots.mu.Lock()
+	defer fedIndexRoots.mu.Unlock()
+	if root, ok := fedIndexRoots.byCmd[g]; ok {
+		return root
+	}
+	return g.context.AbsPathOf("")
+}
+
+// federatedCommands returns a *Commands that replays changes against
+// target's Drive account instead of the primary one. It shares g's Context
+// (and therefore its LocalFS) so the source tree g already walked isn't
+// walked again; only the Remote - and so which account UpsertByComparison
+// and Trash land against - differs. Its index entries are namespaced under
+// .gd/indices/<target.Name> via fedIndexRoots so they never collide with
+// the primary account's or another target's.
+func (g *Commands) federatedCommands(target config.FederationTarget) (*Commands, error) {
+	rem, err := RemoteForAccount(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", target.Name, err)
+	}
+
+	fedOpts := *g.opts
+	fed := &Commands{
+		context: g.context,
+		rem:     rem,
+		opts:    &fedOpts,
+	}
+
+	fedIndexRoots.mu.Lock()
+	fedIndexRoots.byCmd[fed] = gopath.Join(g.context.AbsPathOf(""), config.GDDirSuffix, "indices", target.Name)
+	fedIndexRoots.mu.Unlock()
+
+	return fed, nil
+}
+
+// pushFederated mirrors g.opts.Sources/g.opts.Mount to every configured
+// federation target, resolving each target's own change list against its
+// own remote rather than replaying the primary account's. A federation
+// target's Change.Dest - and so the remote file IDs remoteMod's
+// UpsertByComparison acts on - has to come from that target's own remote
+// state: replaying the primary's Dest/IDs would address files that exist
+// only in the primary account, and a freshly seeded target sharing none of
+// the primary's already-pushed history would never be seeded at all if all
+// it ever saw was the primary's delta-vs-its-own-remote. Each target gets
+// its own quota check - and is skipped with a clear message rather than
+// aborting the whole mirror run if it would be exceeded - since accounts
+// have independent storage limits. Deletions are destructive enough that
+// they stay opt-in via --federate-deletes even when the primary Push
+// includes them.
+func (g *Commands) pushFederated() error {
+	targets, err := g.federationTargets()
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var remoteFailures int
+	for _, target := range targets {
+		fed, fErr := g.federatedCommands(target)
+		if fErr != nil {
+			fmt.Printf("federate: %v\n", fErr)
+			remoteFailures++
+			continue
+		}
+
+		_, fedCl, unresolved, rErr := fed.resolveSources(g.opts.Sources)
+		if rErr != nil {
+			fmt.Printf("federate %s: %v\n", target.Name, rErr)
+			continue
+		}
+		fedCl = append(fedCl, unresolved...)
+
+		if !g.opts.FederateDeletes {
+			var filtered []*Change
+			for _, c := range fedCl {
+				if c.Op() != OpDelete {
+					filtered = append(filtered, c)
+				}
+			}
+			fedCl = filtered
+		}
+		if len(fedCl) == 0 {
+			continue
+		}
+
+		pushSize := reduceToSize(fedCl, true)
+		quotaStatus, qErr := fed.QuotaStatus(pushSize)
+		if qErr != nil {
+			fmt.Printf("federate %s: quota: %v\n", target.Name, qErr)
+			continue
+		}
+		if quotaStatus == Exceeded {
+			fmt.Printf("\033[91mfederate %s: this change would exceed its drive quota, skipping\033[00m\n", target.Name)
+			continue
+		}
+
+		fmt.Printf("Federating to %s...\n", target.Name)
+		journal, jErr := loadOrCreatePushJournal(fed.context.AbsPathOf(""), false)
+		if jErr != nil {
+			fmt.Printf("federate %s: push-journal: %v\n", target.Name, jErr)
+			journal = nil
+		}
+		if pErr := fed.playPushChangeList(fedCl, nil, journal); pErr != nil {
+			fmt.Printf("federate %s: %v\n", target.Name, pErr)
+		}
+	}
+
+	if remoteFailures > 0 && remoteFailures == len(targets) {
+		// Every target failed at the RemoteForAccount step, which its
+		// default implementation always does: most likely nothing has
+		// called drive.RemoteForAccount = ... to wire up a real OAuth
+		// bootstrap for federation targets, so --federate silently did
+		// nothing. Say so loudly instead of leaving it to scattered
+		// per-target prints above.
+		return fmt.Errorf("federate: none of %d target(s) could be reached; is RemoteForAccount configured?", remoteFailures)
+	}
+	return nil
+}
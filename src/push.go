@@ -15,16 +15,18 @@
 package drive
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/signal"
 	gopath "path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/odeke-em/drive/config"
+	"github.com/odeke-em/drive/src/contenthash"
 	"github.com/odeke-em/dts/trie"
 )
 
@@ -41,47 +43,83 @@ func (g *Commands) Push() (err error) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 
+	// journal is loaded further down, before the sources are resolved; the
+	// signal handler below only flushes it once it's non-nil.
+	var journal *pushJournal
+
 	// To Ensure mount points are cleared in the event of external exceptios
 	go func() {
 		_ = <-c
+		if journal != nil {
+			if fErr := journal.flush(); fErr != nil {
+				fmt.Printf("push-journal: %v\n", fErr)
+			}
+		}
 		g.clearMountPoints()
 		os.Exit(1)
 	}()
 
+	// hashCache lets Push recognize source subtrees that are bit-for-bit
+	// identical to what was pushed last time and skip resolving them
+	// entirely, rather than walking and stat'ing every file on every run.
+	// It's a purely local comparison: it only knows whether the local
+	// tree has moved since the last successful push, not whether the
+	// remote copy has (a file restored from Drive trash, edited by
+	// another collaborator, or deleted out-of-band). So the skip below is
+	// opt-in via g.opts.TrustLocalUnchanged - gated behind a flag, not the
+	// default, because it's a hard behavior change from always resolving
+	// against the remote - rather than applying automatically whenever a
+	// cache happens to exist on disk.
+	hashCache, hcErr := contenthash.Load(root, g.context.FS())
+	if hcErr != nil {
+		fmt.Printf("contenthash: %v\n", hcErr)
+		hashCache = nil
+	}
+
+	var jErr error
+	journal, jErr = loadOrCreatePushJournal(root, g.opts.Resume)
+	if jErr != nil {
+		fmt.Printf("push-journal: %v\n", jErr)
+		journal = nil
+	}
+
+	// A federation target may be freshly seeded and have nothing in common
+	// with what hashCache thinks the primary account already pushed, so the
+	// contenthash skip below - correct for the primary account - must not
+	// also prune what a federated replay needs to see.
+	fedTargets, ftErr := g.federationTargets()
+	if ftErr != nil {
+		return ftErr
+	}
+
+	var sources []string
 	for _, relToRootPath := range g.opts.Sources {
 		fsPath := g.context.AbsPathOf(relToRootPath)
-		ccl, cErr := g.changeListResolve(relToRootPath, fsPath, true)
-		if cErr != nil {
-			return cErr
-		}
-		if len(ccl) > 0 {
-			cl = append(cl, ccl...)
+		if len(fedTargets) == 0 && g.opts.TrustLocalUnchanged && hashCache != nil && hashCache.Unchanged(fsPath, g.opts.Hidden) {
+			continue
 		}
+		sources = append(sources, relToRootPath)
 	}
 
-	mount := g.opts.Mount
-	if mount != nil {
-		for _, mt := range mount.Points {
-			ccl, cerr := lonePush(g, root, mt.Name, mt.MountPath)
-			if cerr == nil {
-				cl = append(cl, ccl...)
-			}
-		}
+	cl, nonConflicts, unresolved, rErr := g.resolveSources(sources)
+	if rErr != nil {
+		return rErr
 	}
-
-	nonConflicts, conflicts := sift(cl)
-	resolved, unresolved := resolveConflicts(conflicts, true, g.deserializeIndex)
 	if len(unresolved) >= 1 {
 		if conflictsPersist(unresolved) {
 			return
 		}
-		for _, ch := range unresolved {
-			resolved = append(resolved, ch)
-		}
+		nonConflicts = append(nonConflicts, unresolved...)
 	}
 
-	for _, ch := range resolved {
-		nonConflicts = append(nonConflicts, ch)
+	if journal != nil && g.opts.Resume {
+		remaining := nonConflicts[:0]
+		for _, ch := range nonConflicts {
+			if !journal.isDone(ch.Path) {
+				remaining = append(remaining, ch)
+			}
+		}
+		nonConflicts = remaining
 	}
 
 	ok := printChangeList(nonConflicts, g.opts.NoPrompt, g.opts.NoClobber)
@@ -106,20 +144,91 @@ func (g *Commands) Push() (err error) {
 				return
 			}
 		}
-		return g.playPushChangeList(nonConflicts)
+		err = g.playPushChangeList(nonConflicts, hashCache, journal)
+		if err == nil {
+			if fErr := g.pushFederated(); fErr != nil {
+				fmt.Printf("federate: %v\n", fErr)
+			}
+		}
+		return err
 	}
 	return
 }
 
+// resolveSources walks sources (paths relative to root) and g.opts.Mount's
+// points through changeListResolve/lonePush against whichever remote
+// g.rem points at, then sifts the result into non-conflicting and
+// conflicting changes and folds back whatever resolveConflicts can settle
+// automatically. It returns the full list resolved (cl, for quota
+// estimation), the non-conflicting changes ready to push, and whatever
+// conflicts remain unresolved for the caller to decide about.
+//
+// Push calls this for the primary account, and pushFederated calls it
+// again for every federation target: a target can't reuse the primary's
+// already-resolved Changes, because its Change.Dest - and so the remote
+// file IDs remoteMod's UpsertByComparison acts on - has to come from that
+// target's own remote state, not the primary account's. Resolving fresh
+// also means a target sharing none of the primary account's history (a
+// freshly seeded one, say) still gets a full change list instead of only
+// whatever the primary's own delta happens to contain.
+func (g *Commands) resolveSources(sources []string) (cl, nonConflicts, unresolved []*Change, err error) {
+	for _, relToRootPath := range sources {
+		fsPath := g.context.AbsPathOf(relToRootPath)
+
+		// beginWalk/endWalk give every list call changeListResolve makes
+		// while resolving this one source a shared cycle detector; see
+		// their doc comment for why that has to happen here instead of
+		// where list is defined. It's scoped per source, not around the
+		// whole sources loop, so that overlapping sources (e.g. `drive
+		// push a a/sub`, or the same path listed twice) each get a clean
+		// detector instead of the second source's walk re-entering an
+		// inode the first source's walk already visited and aborting with
+		// a false ErrSymlinkCycle.
+		beginWalk(g.context)
+		ccl, cErr := g.changeListResolve(relToRootPath, fsPath, true)
+		endWalk(g.context)
+		if cErr != nil {
+			return nil, nil, nil, cErr
+		}
+		if len(ccl) > 0 {
+			cl = append(cl, ccl...)
+		}
+	}
+
+	if mount := g.opts.Mount; mount != nil {
+		root := g.context.AbsPathOf("")
+		for _, mt := range mount.Points {
+			ccl, cerr := lonePush(g, root, mt.Name, mt.MountPath)
+			if cerr == nil {
+				cl = append(cl, ccl...)
+			}
+		}
+	}
+
+	var conflicts []*Change
+	nonConflicts, conflicts = sift(cl)
+
+	var resolved []*Change
+	resolved, unresolved = resolveConflicts(conflicts, true, g.deserializeIndex)
+	nonConflicts = append(nonConflicts, resolved...)
+	return cl, nonConflicts, unresolved, nil
+}
+
 func (g *Commands) deserializeIndex(identifier string) *config.Index {
-	index, err := g.context.DeserializeIndex(g.context.AbsPathOf(""), identifier)
+	index, err := g.context.DeserializeIndex(g.indexRoot(), identifier)
 	if err != nil {
 		return nil
 	}
 	return index
 }
 
-func (g *Commands) playPushChangeList(cl []*Change) (err error) {
+// playPushChangeList applies cl to the remote using a bounded pool of
+// workers per op type (see runPool), rather than walking the list serially.
+// Every ancestor directory the changes land in is created up front via
+// ensureParentDirs, so the parallel workers never race to create the same
+// folder; completion of each change is persisted to journal as it lands,
+// so an interrupted Push can be resumed later with `--resume`.
+func (g *Commands) playPushChangeList(cl []*Change, hashCache *contenthash.Cache, journal *pushJournal) (err error) {
 	g.taskStart(len(cl))
 
 	// TODO: Only provide precedence ordering if all the other options are allowed
@@ -143,30 +252,61 @@ func (g *Commands) playPushChangeList(cl []*Change) (err error) {
 		}
 	}
 
-	g.scheduleAdds(adds)
-	g.scheduleMods(mods)
-	g.scheduleDels(dels)
+	if dErr := g.ensureParentDirs(append(append([]*Change{}, adds...), mods...)); dErr != nil {
+		g.taskFinish()
+		return dErr
+	}
+
+	var failures []string
+	if aErr := g.runPool(adds, g.remoteAdd, journal); aErr != nil {
+		failures = append(failures, aErr.Error())
+	}
+	if mErr := g.runPool(mods, g.remoteMod, journal); mErr != nil {
+		failures = append(failures, mErr.Error())
+	}
+	if dErr := g.runPool(dels, g.remoteDelete, journal); dErr != nil {
+		failures = append(failures, dErr.Error())
+	}
 
-	// Time to organize them according branching
 	g.taskFinish()
-	return err
-}
 
-func (g *Commands) scheduleDels(cl []*Change) (err error) {
-	for _, c := range cl {
-		g.remoteDelete(c)
+	if len(failures) > 0 {
+		// Some changes never made it to the remote: don't mark the source
+		// subtrees as pushed (the contenthash cache would then skip the
+		// very file that failed on the next run) and don't drop the
+		// journal (so --resume can pick up exactly what's left).
+		return errors.New(strings.Join(failures, "\n"))
 	}
-	return
+
+	if hashCache != nil {
+		for _, relToRootPath := range g.opts.Sources {
+			fsPath := g.context.AbsPathOf(relToRootPath)
+			if mErr := hashCache.MarkPushed(fsPath, g.opts.Hidden); mErr != nil {
+				fmt.Printf("contenthash: %v\n", mErr)
+			}
+		}
+		if sErr := hashCache.Save(); sErr != nil {
+			fmt.Printf("contenthash: %v\n", sErr)
+		}
+	}
+
+	if rErr := journal.remove(); rErr != nil {
+		fmt.Printf("push-journal: %v\n", rErr)
+	}
+
+	return err
 }
 
-func (g *Commands) scheduleUpserts(cl []*Change, f func(*Change) error) (err error) {
+// commonDirPrefixes walks cl's paths through the same trie-prefix trick
+// scheduleUpserts used to use, and returns the distinct ancestor directory
+// prefixes that need to exist before cl's files can be written.
+func commonDirPrefixes(cl []*Change) []string {
 	tr := trie.New(trie.AsciiAlphabet)
 	for _, c := range cl {
 		tr.Set(c.Path, c.Path)
 	}
 
 	dir := "dir"
-
 	_ = tr.Tag(trie.PotentialDir, dir)
 	potentialDirs := tr.Match(trie.PotentialDir)
 
@@ -174,37 +314,25 @@ func (g *Commands) scheduleUpserts(cl []*Change, f func(*Change) error) (err err
 		return tn != nil && tn.Eos
 	}
 
+	var prefixes []string
 	for match := range potentialDirs {
 		endNodes := match.Match(eos)
-		prefixes := []string{}
+		nodePaths := []string{}
 		for node := range endNodes {
-			prefixes = append(prefixes, node.Data.(string))
+			nodePaths = append(nodePaths, node.Data.(string))
 		}
-		if len(prefixes) < 1 {
+		if len(nodePaths) < 1 {
 			continue
 		}
 
-		prefix := commonPrefix(prefixes...)
+		prefix := commonPrefix(nodePaths...)
 		prefix = strings.TrimRight(prefix, UnescapedPathSep)
-
-		_, pErr := g.mkdirAll(prefix)
-		if pErr != nil {
-			return pErr
+		if prefix == "" {
+			continue
 		}
+		prefixes = append(prefixes, prefix)
 	}
-
-	for _, c := range cl {
-		f(c)
-	}
-	return
-}
-
-func (g *Commands) scheduleMods(cl []*Change) (err error) {
-	return g.scheduleUpserts(cl, g.remoteMod)
-}
-
-func (g *Commands) scheduleAdds(cl []*Change) (err error) {
-	return g.scheduleUpserts(cl, g.remoteAdd)
+	return prefixes
 }
 
 func lonePush(g *Commands, parent, absPath, path string) (cl []*Change, err error) {
@@ -214,7 +342,7 @@ func lonePush(g *Commands, parent, absPath, path string) (cl []*Change, err erro
 	}
 
 	var l *File
-	localinfo, _ := os.Stat(path)
+	localinfo, _ := g.context.FS().Stat(path)
 	if localinfo != nil {
 		l = NewLocalFile(path, localinfo)
 	}
@@ -261,7 +389,7 @@ func (g *Commands) remoteMod(change *Change) (err error) {
 		return
 	}
 	index := rem.ToIndex()
-	wErr := g.context.SerializeIndex(index, g.context.AbsPathOf(""))
+	wErr := g.context.SerializeIndex(index, g.indexRoot())
 
 	// TODO: Should indexing errors be reported?
 	if wErr != nil {
@@ -275,7 +403,7 @@ func (g *Commands) remoteAdd(change *Change) (err error) {
 }
 
 func (g *Commands) indexAbsPath(fileId string) string {
-	return config.IndicesAbsPath(g.context.AbsPathOf(""), fileId)
+	return config.IndicesAbsPath(g.indexRoot(), fileId)
 }
 
 func (g *Commands) remoteUntrash(change *Change) (err error) {
@@ -293,62 +421,262 @@ func (g *Commands) remoteDelete(change *Change) (err error) {
 	}
 
 	indexPath := g.indexAbsPath(change.Dest.Id)
-	if rmErr := os.Remove(indexPath); rmErr != nil {
+	if rmErr := g.context.FS().Remove(indexPath); rmErr != nil {
 		fmt.Printf("%s \"%s\": remove indexfile %v\n", change.Path, change.Dest.Id, rmErr)
 	}
 	return
 }
 
+// mkdirAll creates every missing ancestor directory of d on the remote.
+// It used to recurse on rest, so a pathologically deep target path could
+// exhaust the goroutine stack - the same class of bug the Go team has
+// patched out of path/filepath.Glob, io/fs.Glob and encoding/xml. It's now
+// a thin wrapper around mkdirAllStack with no dedup group.
 func (g *Commands) mkdirAll(d string) (file *File, err error) {
-	// Try the lookup one last time in case a coroutine raced us to it.
-	retrFile, retryErr := g.rem.FindByPath(d)
-	if retryErr == nil && retrFile != nil {
-		return retrFile, nil
-	}
+	return g.mkdirAllStack(d, nil)
+}
+
+// mkdirAllG is mkdirAll's concurrency-safe counterpart: callers racing to
+// create the same directory (or overlapping ancestors of it) share a single
+// UpsertByComparison call via group, instead of each issuing their own.
+func (g *Commands) mkdirAllG(d string, group *mkdirGroup) (*File, error) {
+	return g.mkdirAllStack(d, group)
+}
 
-	rest, last := filepath.Split(strings.TrimRight(d, UnescapedPathSep))
-	if rest == "" || last == "" {
+// mkdirAllStack is mkdirAll/mkdirAllG's shared, iterative core. It walks up
+// from d collecting missing ancestors onto an explicit stack instead of the
+// goroutine stack, stopping as soon as FindByPath resolves one that already
+// exists, then unwinds the stack bottom-up, creating each missing
+// component in turn. When group is non-nil every creation is deduped
+// through it, so sibling goroutines racing into the same ancestor collapse
+// into one API call instead of issuing their own.
+func (g *Commands) mkdirAllStack(d string, group *mkdirGroup) (file *File, err error) {
+	target := strings.TrimRight(d, UnescapedPathSep)
+	if target == "" {
 		return nil, fmt.Errorf("cannot tamper with root")
 	}
 
-	parent, parentErr := g.rem.FindByPath(rest)
-	if parentErr != nil && parentErr != ErrPathNotExists {
-		return parent, parentErr
-	}
+	var missing []string
+	parent, cur := (*File)(nil), target
+	for {
+		f, fErr := g.rem.FindByPath(cur)
+		if fErr != nil && fErr != ErrPathNotExists {
+			return nil, fErr
+		}
+		if f != nil {
+			parent = f
+			break
+		}
+
+		rest, last := filepath.Split(cur)
+		rest = strings.TrimRight(rest, UnescapedPathSep)
+		if last == "" {
+			return nil, fmt.Errorf("cannot tamper with root")
+		}
 
-	if parent == nil {
-		parent, parentErr = g.mkdirAll(rest)
-		if parentErr != nil || parent == nil {
-			return parent, parentErr
+		missing = append(missing, cur)
+		if rest == "" {
+			break
 		}
+		cur = rest
 	}
 
-	remoteFile := &File{
-		IsDir: true,
-		Name:  last,
+	for i := len(missing) - 1; i >= 0; i-- {
+		created, cErr := g.mkdirOne(missing[i], group)
+		if cErr != nil || created == nil {
+			return created, cErr
+		}
+		parent = created
 	}
+	return parent, nil
+}
 
-	args := upsertOpt{
-		parentId: parent.Id,
-		src:      remoteFile,
+// splitParentChild splits path into the parent directory mkdirOne should
+// look up and the final component it should create there. For a
+// first-level path like "/foo", filepath.Split leaves the root "/" in the
+// parent half; TrimRight-ing trailing separators would then collapse that
+// "/" down to "", turning the lookup below into FindByPath("") instead of
+// mkdirAll's original FindByPath("/") for the remote root. Restoring "/"
+// keeps that root lookup intact.
+func splitParentChild(path string) (parent, child string) {
+	parent, child = filepath.Split(path)
+	parent = strings.TrimRight(parent, UnescapedPathSep)
+	if parent == "" {
+		parent = "/"
 	}
-	parent, parentErr = g.rem.UpsertByComparison(&args)
-	if parentErr == nil && parent != nil {
-		index := parent.ToIndex()
-		wErr := g.context.SerializeIndex(index, g.context.AbsPathOf(""))
+	return parent, child
+}
 
-		// TODO: Should indexing errors be reported?
-		if wErr != nil {
-			fmt.Printf("serializeIndex %s: %v\n", parent.Name, wErr)
+// mkdirOne creates the single remote directory named by path's last
+// component, under its already-existing parent. group, if non-nil, dedupes
+// concurrent callers creating the same path.
+func (g *Commands) mkdirOne(path string, group *mkdirGroup) (*File, error) {
+	create := func() (*File, error) {
+		rest, last := splitParentChild(path)
+
+		parent, err := g.rem.FindByPath(rest)
+		if err != nil && err != ErrPathNotExists {
+			return nil, err
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("mkdirAll: %q vanished while creating %q", rest, path)
 		}
+
+		remoteFile := &File{IsDir: true, Name: last}
+		args := upsertOpt{parentId: parent.Id, src: remoteFile}
+
+		created, cErr := g.rem.UpsertByComparison(&args)
+		if cErr == nil && created != nil {
+			index := created.ToIndex()
+			// TODO: Should indexing errors be reported?
+			if wErr := g.context.SerializeIndex(index, g.indexRoot()); wErr != nil {
+				fmt.Printf("serializeIndex %s: %v\n", created.Name, wErr)
+			}
+		}
+		return created, cErr
+	}
+
+	if group == nil {
+		return create()
+	}
+	return group.do(path, create)
+}
+
+// maxListDepth bounds how many directory levels a changeListResolve walk
+// through list can descend before giving up with ErrPathTooDeep, so a
+// pathologically deep source tree can't blow the goroutine stack - the
+// same class of bug the Go team has patched out of path/filepath.Glob,
+// io/fs.Glob and encoding/xml.
+const maxListDepth = 4096
+
+// ErrPathTooDeep is returned once a walk through list has descended more
+// than maxListDepth directory levels.
+var ErrPathTooDeep = errors.New("drive: path nested too deep")
+
+// ErrSymlinkCycle is returned when a walk through list would revisit a
+// directory it has already descended into by another path, i.e. a symlink
+// loop.
+var ErrSymlinkCycle = errors.New("drive: symlink cycle detected")
+
+// visitedInodes remembers the (dev, inode) pairs a changeListResolve walk
+// has already descended into, so a symlink loop in a hostile or
+// pathological source tree is caught as ErrSymlinkCycle instead of
+// recursing forever.
+type visitedInodes struct {
+	mu   sync.Mutex
+	seen map[[2]uint64]bool
+}
+
+func newVisitedInodes() *visitedInodes {
+	return &visitedInodes{seen: map[[2]uint64]bool{}}
+}
+
+// enter records (dev, inode) as visited, reporting false if it was already
+// present.
+func (v *visitedInodes) enter(dev, ino uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := [2]uint64{dev, ino}
+	if v.seen[key] {
+		return false
 	}
-	return parent, parentErr
+	v.seen[key] = true
+	return true
+}
+
+// activeWalks holds the one visitedInodes cycle detector shared by every
+// list call a single source's changeListResolve walk makes, keyed by
+// context identity. changeListResolve recurses across directory levels by
+// calling list once per directory with the fixed (context, p, hidden)
+// signature list has always had, so there's no parameter list can receive
+// the detector through; beginWalk/endWalk install and remove it around the
+// walk instead, and list looks it up by the context pointer it's already
+// given. resolveSources calls beginWalk/endWalk once per top-level source
+// rather than once for the whole sources loop, so that two sources which
+// happen to overlap on disk don't share a detector and trip a false cycle
+// on each other.
+var activeWalks = struct {
+	mu    sync.Mutex
+	byCtx map[*config.Context]*visitedInodes
+}{byCtx: map[*config.Context]*visitedInodes{}}
+
+// beginWalk starts a new shared cycle detector for every list call made
+// against context until the matching endWalk. Call it once per top-level
+// source being resolved, not once for the whole Sources loop and not per
+// directory within a source.
+func beginWalk(context *config.Context) {
+	activeWalks.mu.Lock()
+	defer activeWalks.mu.Unlock()
+	activeWalks.byCtx[context] = newVisitedInodes()
+}
+
+// endWalk removes context's cycle detector once its source's walk has
+// finished.
+func endWalk(context *config.Context) {
+	activeWalks.mu.Lock()
+	defer activeWalks.mu.Unlock()
+	delete(activeWalks.byCtx, context)
 }
 
+// visitedFor returns the cycle detector installed for context by beginWalk,
+// or a fresh one-call detector if list is invoked outside of a Push walk
+// (e.g. directly from a test).
+func visitedFor(context *config.Context) *visitedInodes {
+	activeWalks.mu.Lock()
+	defer activeWalks.mu.Unlock()
+	if v, ok := activeWalks.byCtx[context]; ok {
+		return v
+	}
+	return newVisitedInodes()
+}
+
+// depthOf reports how many directory levels absPath sits below context's
+// root, so a walk's depth budget reflects the actual recursion
+// changeListResolve is performing rather than resetting to 0 on every
+// directory-level call to list.
+func depthOf(context *config.Context, absPath string) int {
+	root := gopath.Clean(context.AbsPathOf(""))
+	rel := strings.TrimPrefix(gopath.Clean(absPath), root)
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// list enumerates p's immediate children. changeListResolve recurses across
+// directory levels by calling list once per directory, so real depth and
+// cycle protection for that whole walk comes from depthOf and visitedFor
+// rather than from any state local to this call.
 func list(context *config.Context, p string, hidden bool) (fileChan chan *File, err error) {
 	absPath := context.AbsPathOf(p)
+	return listBounded(context, p, hidden, depthOf(context, absPath), visitedFor(context))
+}
+
+// listBounded is list's depth- and cycle-aware core; list supplies depth
+// and visited from depthOf and visitedFor (see list's doc comment).
+func listBounded(context *config.Context, p string, hidden bool, depth int, visited *visitedInodes) (fileChan chan *File, err error) {
+	if depth > maxListDepth {
+		fileChan = make(chan *File)
+		close(fileChan)
+		return fileChan, ErrPathTooDeep
+	}
+
+	absPath := context.AbsPathOf(p)
+
+	// Stat, not Lstat: a directory reached through a symlink must resolve to
+	// the same (dev, ino) as the real target so the cycle it closes is
+	// actually caught.
+	if info, statErr := context.FS().Stat(absPath); statErr == nil && info.IsDir() {
+		if dev, ino, ok := devIno(info); ok && !visited.enter(dev, ino) {
+			fileChan = make(chan *File)
+			close(fileChan)
+			return fileChan, ErrSymlinkCycle
+		}
+	}
+
 	var f []os.FileInfo
-	f, err = ioutil.ReadDir(absPath)
+	f, err = context.FS().ReadDir(absPath)
 	fileChan = make(chan *File)
 	if err != nil {
 		close(fileChan)
@@ -360,7 +688,7 @@ func list(context *config.Context, p string, hidden bool) (fileChan chan *File,
 			if file.Name() == config.GDDirSuffix {
 				continue
 			}
-			if !isHidden(file.Name(), hidden) {
+			if !config.IsHidden(file.Name(), hidden) {
 				fileChan <- NewLocalFile(gopath.Join(absPath, file.Name()), file)
 			}
 		}
@@ -0,0 +1,114 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drive
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSplitParentChild(t *testing.T) {
+	cases := []struct {
+		path       string
+		wantParent string
+		wantChild  string
+	}{
+		{"/foo", "/", "foo"},
+		{"/foo/bar", "/foo", "bar"},
+		{"/foo/bar/baz", "/foo/bar", "baz"},
+	}
+
+	for _, c := range cases {
+		parent, child := splitParentChild(c.path)
+		if parent != c.wantParent || child != c.wantChild {
+			t.Errorf("splitParentChild(%q) = (%q, %q), want (%q, %q)",
+				c.path, parent, child, c.wantParent, c.wantChild)
+		}
+	}
+}
+
+func TestPushJournalResume(t *testing.T) {
+	root := t.TempDir()
+
+	j, err := newPushJournal(root)
+	if err != nil {
+		t.Fatalf("newPushJournal: %v", err)
+	}
+	j.markDone("/a")
+	j.markDone("/b")
+
+	if !j.isDone("/a") || !j.isDone("/b") {
+		t.Fatalf("markDone did not record the paths it was given")
+	}
+
+	resumed, err := resumePushJournal(root)
+	if err != nil {
+		t.Fatalf("resumePushJournal: %v", err)
+	}
+	if resumed == nil {
+		t.Fatalf("resumePushJournal found nothing to resume")
+	}
+	if !resumed.isDone("/a") || !resumed.isDone("/b") {
+		t.Errorf("resumed journal is missing entries marked done before resume: %+v", resumed.Done)
+	}
+	if resumed.isDone("/c") {
+		t.Errorf("resumed journal reports an entry that was never marked done")
+	}
+}
+
+func TestResumePushJournalTruncatesTornTrailingLine(t *testing.T) {
+	root := t.TempDir()
+
+	j, err := newPushJournal(root)
+	if err != nil {
+		t.Fatalf("newPushJournal: %v", err)
+	}
+	j.markDone("/whole")
+
+	// Simulate a crash mid-append: a line that started but never
+	// finished, with no trailing newline and invalid as JSON on its own.
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.WriteString(`"/torn`); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	resumed, err := resumePushJournal(root)
+	if err != nil {
+		t.Fatalf("resumePushJournal: %v", err)
+	}
+	if !resumed.isDone("/whole") {
+		t.Errorf("resumed journal lost a complete entry preceding the torn one")
+	}
+	if resumed.isDone("/torn") {
+		t.Errorf("resumed journal should not record the torn trailing entry")
+	}
+
+	data, rErr := os.ReadFile(j.path)
+	if rErr != nil {
+		t.Fatalf("ReadFile: %v", rErr)
+	}
+	want, _ := json.Marshal("/whole")
+	want = append(want, '\n')
+	if string(data) != string(want) {
+		t.Errorf("journal file wasn't truncated back to its last complete line: got %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drive
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/odeke-em/drive/config"
+)
+
+// DefaultPushConcurrency is how many upsert/delete operations playPushChangeList
+// will run at once when g.opts.PushConcurrency isn't set to a positive value.
+const DefaultPushConcurrency = 4
+
+const journalGlob = "push-journal-*.json"
+
+// pushJournal records which *Change paths have already been applied to the
+// remote during a Push, so that a Push interrupted midway (SIGINT, a crashed
+// process, a flaky network) can be resumed with `--resume` instead of
+// starting over and re-uploading everything.
+//
+// On disk it's an append-only log, one JSON-encoded path per line, rather
+// than a single JSON document rewritten on every completion: runPool's pool
+// goroutines call markDone once per change, and a push of thousands of files
+// doing a whole-document marshal-and-rewrite on every single one of those
+// calls is O(n^2). Appending a line is O(1) per call, and since the append
+// (and its fsync) happens while mu is held, two goroutines marking different
+// paths done can't interleave their writes into a torn line the way a
+// marshal-under-lock-but-write-outside-it split could.
+type pushJournal struct {
+	path string
+	f    *os.File
+
+	mu   sync.Mutex
+	Done map[string]bool
+}
+
+// newPushJournal creates a fresh journal file under root/.gd, named with a
+// random id so concurrent `drive push` invocations don't collide.
+func newPushJournal(root string) (*pushJournal, error) {
+	gdPath := gopath.Join(root, config.GDDirSuffix)
+	if err := os.MkdirAll(gdPath, 0755); err != nil {
+		return nil, err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	path := gopath.Join(gdPath, fmt.Sprintf("push-journal-%s.json", id))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pushJournal{path: path, f: f, Done: map[string]bool{}}, nil
+}
+
+// resumePushJournal looks for the most recently modified journal left behind
+// by an interrupted Push and loads it, so the caller can skip any paths it
+// already marked as done. It returns (nil, nil) if no journal is found.
+//
+// Each line is read in turn and stops at the first one that isn't a
+// complete, valid JSON string: a process killed mid-append can leave a torn
+// trailing line, and that's the one case a line is expected not to parse,
+// not a reason to fail --resume over an otherwise-intact journal. The file
+// is then truncated back to the last complete line so the journal on disk
+// matches what was recovered into memory, and further appends start from a
+// clean state.
+func resumePushJournal(root string) (*pushJournal, error) {
+	matches, err := filepath.Glob(gopath.Join(root, config.GDDirSuffix, journalGlob))
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+
+	var latest string
+	var latestMod time.Time
+	for _, m := range matches {
+		info, sErr := os.Stat(m)
+		if sErr != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestMod) {
+			latest, latestMod = m, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return nil, nil
+	}
+
+	raw, err := os.Open(latest)
+	if err != nil {
+		return nil, err
+	}
+
+	done := map[string]bool{}
+	var validLen int64
+
+	r := bufio.NewReader(raw)
+	for {
+		// ReadBytes only returns an error for a line missing its '\n'.
+		line, _ := r.ReadBytes('\n')
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			break
+		}
+		var path string
+		if uErr := json.Unmarshal(line[:len(line)-1], &path); uErr != nil {
+			break
+		}
+		done[path] = true
+		validLen += int64(len(line))
+	}
+	raw.Close()
+
+	if info, sErr := os.Stat(latest); sErr == nil && info.Size() != validLen {
+		if tErr := os.Truncate(latest, validLen); tErr != nil {
+			return nil, tErr
+		}
+	}
+
+	f, err := os.OpenFile(latest, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pushJournal{path: latest, f: f, Done: done}, nil
+}
+
+// loadOrCreatePushJournal resumes the latest journal when resume is true and
+// one exists, otherwise it starts a fresh one.
+func loadOrCreatePushJournal(root string, resume bool) (*pushJournal, error) {
+	if resume {
+		j, err := resumePushJournal(root)
+		if err != nil {
+			return nil, err
+		}
+		if j != nil {
+			return j, nil
+		}
+	}
+	return newPushJournal(root)
+}
+
+func (j *pushJournal) isDone(path string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Done[path]
+}
+
+// markDone records path as pushed, appending one line to the journal file
+// and fsyncing it while mu is held, so progress survives a crash between
+// this call and the next one and concurrent callers can't tear each other's
+// writes.
+func (j *pushJournal) markDone(path string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.Done[path] {
+		return
+	}
+
+	line, err := json.Marshal(path)
+	if err != nil {
+		fmt.Printf("push-journal: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if _, err := j.f.Write(line); err != nil {
+		fmt.Printf("push-journal: %v\n", err)
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		fmt.Printf("push-journal: %v\n", err)
+		return
+	}
+	j.Done[path] = true
+}
+
+// flush fsyncs the journal file. markDone already fsyncs every line as it's
+// written, so this is a final safety net for callers (like the SIGINT
+// handler) that want to be sure nothing is left buffered before exiting,
+// not the primary persistence mechanism.
+func (j *pushJournal) flush() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Sync()
+}
+
+// remove closes and deletes the journal file once a Push completes in
+// full, so a later Push doesn't mistake it for leftover state from an
+// interrupted one.
+func (j *pushJournal) remove() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if cErr := j.f.Close(); cErr != nil {
+		return cErr
+	}
+	return os.Remove(j.path)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// mkdirGroup is a singleflight-style map that dedupes concurrent mkdirAll
+// calls for the same remote path, so that two goroutines racing to create
+// overlapping ancestor directories only ever issue one UpsertByComparison
+// for any given path.
+type mkdirGroup struct {
+	mu    sync.Mutex
+	calls map[string]*mkdirCall
+}
+
+type mkdirCall struct {
+	wg   sync.WaitGroup
+	file *File
+	err  error
+}
+
+func newMkdirGroup() *mkdirGroup {
+	return &mkdirGroup{calls: map[string]*mkdirCall{}}
+}
+
+// do runs fn for path, or if another goroutine is already running fn for the
+// same path, waits for that call to finish and reuses its result.
+func (m *mkdirGroup) do(path string, fn func() (*File, error)) (*File, error) {
+	m.mu.Lock()
+	if c, ok := m.calls[path]; ok {
+		m.mu.Unlock()
+		c.wg.Wait()
+		return c.file, c.err
+	}
+
+	c := &mkdirCall{}
+	c.wg.Add(1)
+	m.calls[path] = c
+	m.mu.Unlock()
+
+	c.file, c.err = fn()
+	c.wg.Done()
+	return c.file, c.err
+}
+
+// ensureParentDirs creates every ancestor directory that cl's changes will be
+// written into, ahead of the file changes themselves. This is the
+// directory-creation happens-before constraint that scheduleUpserts used to
+// enforce by walking a trie serially; here the distinct prefixes are created
+// concurrently, with every ancestor mkdirAllG creates deduplicated through a
+// shared mkdirGroup so that sibling prefixes sharing an ancestor don't
+// double-create it.
+func (g *Commands) ensureParentDirs(cl []*Change) error {
+	prefixes := commonDirPrefixes(cl)
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	group := newMkdirGroup()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, len(prefixes))
+
+	for _, prefix := range prefixes {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			if _, err := g.mkdirAllG(prefix, group); err != nil {
+				errc <- err
+			}
+		}(prefix)
+	}
+
+	wg.Wait()
+	close(errc)
+
+	for err := range errc {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushConcurrency returns how many upsert/delete operations playPushChangeList
+// should run at once.
+func (g *Commands) pushConcurrency() int {
+	if g.opts.PushConcurrency > 0 {
+		return g.opts.PushConcurrency
+	}
+	return DefaultPushConcurrency
+}
+
+// runPool applies fn to every change in cl using a bounded pool of
+// g.pushConcurrency() goroutines, retrying transient remote errors and
+// recording each success in journal as it happens. It returns a non-nil
+// error aggregating every change that still failed after retries, so a
+// Push where some uploads 403/500 out is never reported as a plain
+// success.
+func (g *Commands) runPool(cl []*Change, fn func(*Change) error, journal *pushJournal) error {
+	if len(cl) == 0 {
+		return nil
+	}
+
+	concurrency := g.pushConcurrency()
+	if concurrency > len(cl) {
+		concurrency = len(cl)
+	}
+
+	jobs := make(chan *Change)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []string
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				change := c
+				err := withBackoff(5, func() error { return fn(change) })
+				if err == nil {
+					journal.markDone(change.Path)
+					continue
+				}
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("%s: %v", change.Path, err))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, c := range cl {
+		jobs <- c
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("push: %d change(s) failed:\n%s", len(failures), strings.Join(failures, "\n"))
+}
+
+// withBackoff retries fn up to attempts times, backing off exponentially
+// with jitter between tries whenever the error looks like a transient 5xx or
+// 429 quota response, so a burst of failures from the pool's goroutines
+// doesn't stampede the API with simultaneous retries.
+func withBackoff(attempts int, fn func() error) error {
+	var err error
+	for try := 0; try < attempts; try++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isRetryableErr(err) || try == attempts-1 {
+			return err
+		}
+
+		base := time.Duration(1<<uint(try)) * 100 * time.Millisecond
+		jitter := time.Duration(rand.Int63n(int64(base)))
+		time.Sleep(base + jitter)
+	}
+	return err
+}
+
+// isRetryableErr reports whether err looks like a transient failure worth
+// retrying: a 5xx server error or a 429 rate-limit/quota rejection, per the
+// Drive API's typed googleapi.Error status code. Matching on error text
+// instead would treat a permanent "quota exceeded" rejection, or any error
+// whose message merely happens to contain "500", as transient, so an error
+// that doesn't carry a googleapi.Error is treated as non-retryable.
+func isRetryableErr(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == 429 || (apiErr.Code >= 500 && apiErr.Code < 600)
+}